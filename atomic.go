@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// transactionalWriter is what scan() and the single-file flow write rendered
+// output through: writes are staged, and only take effect on Commit. Abort
+// discards whatever was staged. This closes the truncation window that used
+// to exist between removing the old file and finishing the copy into the new
+// one.
+type transactionalWriter interface {
+	io.Writer
+	Commit() error
+	Abort() error
+}
+
+// stdoutWriter adapts os.Stdout (or any plain writer with nothing to
+// stage/commit) to transactionalWriter.
+type stdoutWriter struct{ io.Writer }
+
+func (stdoutWriter) Commit() error { return nil }
+func (stdoutWriter) Abort() error  { return nil }
+
+// atomicFile buffers writes to a sibling temp file; Commit preserves the mode
+// and ownership of the file it's replacing (if any), optionally leaves a
+// ".bak" copy behind when --backup is set, and renames the temp file into
+// place. Abort discards the temp file without touching outputPath.
+type atomicFile struct {
+	tmp       afero.File
+	tmpPath   string
+	finalPath string
+}
+
+func createAtomicFile(outputPath string) (*atomicFile, error) {
+	dir := path.Dir(outputPath)
+	if err := appFs.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	tmpPath := path.Join(dir, fmt.Sprintf(".%s.tmp.%d", path.Base(outputPath), time.Now().UnixNano()))
+	tmp, err := appFs.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &atomicFile{tmp: tmp, tmpPath: tmpPath, finalPath: outputPath}, nil
+}
+
+func (a *atomicFile) Write(p []byte) (int, error) {
+	return a.tmp.Write(p)
+}
+
+func (a *atomicFile) Commit() error {
+	if err := a.tmp.Close(); err != nil {
+		appFs.Remove(a.tmpPath)
+		return err
+	}
+
+	if info, err := appFs.Stat(a.finalPath); err == nil {
+		if *flags.backup {
+			if err := copyFile(a.finalPath, a.finalPath+".bak"); err != nil {
+				return fmt.Errorf("writing backup: %s", err)
+			}
+		}
+		// Preserve the mode/ownership of the file we're replacing; front
+		// matter "mode:"/"owner:"/"group:" (if any) apply on top afterwards.
+		appFs.Chmod(a.tmpPath, info.Mode())
+		preserveOwnership(info, a.tmpPath)
+	}
+
+	if err := appFs.Rename(a.tmpPath, a.finalPath); err != nil {
+		appFs.Remove(a.tmpPath)
+		return err
+	}
+	return nil
+}
+
+func (a *atomicFile) Abort() error {
+	a.tmp.Close()
+	return appFs.Remove(a.tmpPath)
+}
+
+// preserveOwnership best-effort copies the uid/gid of info onto tmpPath. It's
+// a no-op when the underlying FileInfo isn't backed by a real OS stat_t (e.g.
+// the in-memory filesystem used for --dry-run).
+func preserveOwnership(info os.FileInfo, tmpPath string) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		appFs.Chown(tmpPath, int(stat.Uid), int(stat.Gid))
+	}
+}
+
+func copyFile(src, dst string) error {
+	in, err := appFs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := appFs.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const defaultDatasourceTimeout = 10 * time.Second
+
+// datasourceSpec is a resolved datasource: where to fetch it from and how long
+// to wait before giving up.
+type datasourceSpec struct {
+	URL     string
+	Timeout time.Duration
+}
+
+// datasourceConfig is the shape of one entry under the config file's
+// `datasources:` block.
+type datasourceConfig struct {
+	URL     string `yaml:"url"`
+	Timeout string `yaml:"timeout"`
+}
+
+type datasourcesConfig struct {
+	Datasources map[string]datasourceConfig `yaml:"datasources"`
+}
+
+// DatasourceFlags collects repeated `-d name=url` flags into a name->URL map.
+type DatasourceFlags map[string]string
+
+func (d *DatasourceFlags) String() string {
+	if d == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*d))
+	for name, u := range *d {
+		parts = append(parts, name+"="+u)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (d *DatasourceFlags) Set(value string) error {
+	name, u, found := strings.Cut(value, "=")
+	if !found {
+		return fmt.Errorf("expected name=url, got %q", value)
+	}
+	if *d == nil {
+		*d = DatasourceFlags{}
+	}
+	(*d)[name] = u
+	return nil
+}
+
+// dsRegistry maps datasource name -> where/how to fetch it. Populated once
+// from the config file's `datasources:` block and the repeatable -d flag.
+var dsRegistry = map[string]datasourceSpec{}
+
+// dsCache holds the parsed contents of a datasource keyed by URL, so that a
+// datasource referenced by multiple templates within a single scan() run is
+// only fetched once. Guarded by dsCacheMu since scan() renders concurrently.
+var (
+	dsCacheMu sync.Mutex
+	dsCache   = map[string]interface{}{}
+)
+
+// registerDatasources parses the `datasources:` block out of the raw config
+// file bytes and merges it with any -d name=url flags, which take precedence.
+func registerDatasources(bs []byte) {
+	var raw datasourcesConfig
+	if err := yaml.Unmarshal(bs, &raw); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	for name, dc := range raw.Datasources {
+		timeout := defaultDatasourceTimeout
+		if dc.Timeout != "" {
+			d, err := time.ParseDuration(dc.Timeout)
+			if err != nil {
+				log.Fatalf("invalid timeout for datasource %s: %s", name, err)
+			}
+			timeout = d
+		}
+		dsRegistry[name] = datasourceSpec{URL: dc.URL, Timeout: timeout}
+	}
+
+	for name, u := range flags.datasources {
+		dsRegistry[name] = datasourceSpec{URL: u, Timeout: defaultDatasourceTimeout}
+	}
+}
+
+// datasourceFunc implements the `datasource "name"` template function: it
+// fetches (lazily, once) and parses the named datasource's content.
+func datasourceFunc(name string) (interface{}, error) {
+	spec, ok := dsRegistry[name]
+	if !ok {
+		return nil, fmt.Errorf("datasource %q is not defined", name)
+	}
+
+	dsCacheMu.Lock()
+	v, ok := dsCache[spec.URL]
+	dsCacheMu.Unlock()
+	if ok {
+		return v, nil
+	}
+
+	bs, contentType, err := fetchDatasource(spec)
+	if err != nil {
+		return nil, fmt.Errorf("datasource %q: %s", name, err)
+	}
+
+	v, err = parseDatasourceContent(inferFormat(spec.URL, contentType), bs)
+	if err != nil {
+		return nil, fmt.Errorf("datasource %q: %s", name, err)
+	}
+
+	dsCacheMu.Lock()
+	dsCache[spec.URL] = v
+	dsCacheMu.Unlock()
+	return v, nil
+}
+
+// dsFunc implements `ds "name" "sub.key"`: it fetches the named datasource and
+// then walks a dotted key path into the resulting structure.
+func dsFunc(name string, keyPath string) (interface{}, error) {
+	v, err := datasourceFunc(name)
+	if err != nil {
+		return nil, err
+	}
+	return lookupPath(v, keyPath)
+}
+
+func lookupPath(v interface{}, keyPath string) (interface{}, error) {
+	cur := v
+	for _, key := range strings.Split(keyPath, ".") {
+		switch m := cur.(type) {
+		case map[string]interface{}:
+			next, ok := m[key]
+			if !ok {
+				return nil, fmt.Errorf("no such key %q", key)
+			}
+			cur = next
+		case map[interface{}]interface{}:
+			next, ok := m[key]
+			if !ok {
+				return nil, fmt.Errorf("no such key %q", key)
+			}
+			cur = next
+		default:
+			return nil, fmt.Errorf("cannot look up key %q in %T", key, cur)
+		}
+	}
+	return cur, nil
+}
+
+func fetchDatasource(spec datasourceSpec) ([]byte, string, error) {
+	switch {
+	case strings.HasPrefix(spec.URL, "file://"):
+		bs, err := ioutil.ReadFile(strings.TrimPrefix(spec.URL, "file://"))
+		return bs, "", err
+
+	case strings.HasPrefix(spec.URL, "env://"):
+		return []byte(os.Getenv(strings.TrimPrefix(spec.URL, "env://"))), "text/plain", nil
+
+	case strings.HasPrefix(spec.URL, "http://") || strings.HasPrefix(spec.URL, "https://"):
+		client := http.Client{Timeout: spec.Timeout}
+		resp, err := client.Get(spec.URL)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return nil, "", fmt.Errorf("%s returned %s", spec.URL, resp.Status)
+		}
+		bs, err := ioutil.ReadAll(resp.Body)
+		return bs, resp.Header.Get("Content-Type"), err
+
+	case strings.HasPrefix(spec.URL, "exec://"):
+		command := strings.TrimPrefix(spec.URL, "exec://")
+		ctx, cancel := context.WithTimeout(context.Background(), spec.Timeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		bs, err := cmd.Output()
+		return bs, "", err
+
+	case strings.HasPrefix(spec.URL, "vault://"):
+		return fetchVault(spec)
+
+	default:
+		return nil, "", fmt.Errorf("unsupported datasource scheme in %q", spec.URL)
+	}
+}
+
+func fetchVault(spec datasourceSpec) ([]byte, string, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	token := os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return nil, "", fmt.Errorf("VAULT_ADDR and VAULT_TOKEN must be set for vault:// datasources")
+	}
+
+	secretPath := strings.TrimPrefix(spec.URL, "vault://")
+	req, err := http.NewRequest("GET", strings.TrimSuffix(addr, "/")+"/v1/"+secretPath, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	client := http.Client{Timeout: spec.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, "", fmt.Errorf("vault %s returned %s", secretPath, resp.Status)
+	}
+
+	var envelope struct {
+		Data struct {
+			Data json.RawMessage `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return nil, "", err
+	}
+	return envelope.Data.Data, "application/json", nil
+}
+
+// inferFormat guesses a datasource's encoding from its URL's file extension,
+// falling back to the content-type reported by the source (if any).
+func inferFormat(u string, contentType string) string {
+	parsed, err := url.Parse(u)
+	ext := ""
+	if err == nil {
+		ext = strings.ToLower(path.Ext(parsed.Path))
+	}
+	switch ext {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	case ".csv":
+		return "csv"
+	}
+
+	switch {
+	case strings.Contains(contentType, "json"):
+		return "json"
+	case strings.Contains(contentType, "yaml"):
+		return "yaml"
+	case strings.Contains(contentType, "toml"):
+		return "toml"
+	case strings.Contains(contentType, "csv"):
+		return "csv"
+	}
+
+	return "text"
+}
+
+func parseDatasourceContent(format string, bs []byte) (interface{}, error) {
+	switch format {
+	case "json":
+		var v interface{}
+		err := json.Unmarshal(bs, &v)
+		return v, err
+	case "yaml":
+		var v interface{}
+		err := yaml.Unmarshal(bs, &v)
+		return v, err
+	case "toml":
+		var v interface{}
+		err := toml.Unmarshal(bs, &v)
+		return v, err
+	case "csv":
+		return parseCSV(bs)
+	default:
+		return string(bs), nil
+	}
+}
+
+func parseCSV(bs []byte) (interface{}, error) {
+	r := csv.NewReader(strings.NewReader(string(bs)))
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return []map[string]string{}, nil
+	}
+
+	header := rows[0]
+	records := make([]map[string]string, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		record := make(map[string]string, len(header))
+		for i, col := range header {
+			if i < len(row) {
+				record[col] = row[i]
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
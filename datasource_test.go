@@ -0,0 +1,226 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInferFormat(t *testing.T) {
+	cases := []struct {
+		url         string
+		contentType string
+		want        string
+	}{
+		{"file:///tmp/data.json", "", "json"},
+		{"file:///tmp/data.yaml", "", "yaml"},
+		{"file:///tmp/data.yml", "", "yaml"},
+		{"file:///tmp/data.toml", "", "toml"},
+		{"file:///tmp/data.csv", "", "csv"},
+		{"file:///tmp/data", "text/plain", "text"},
+		{"http://example.com/data", "application/json; charset=utf-8", "json"},
+		{"http://example.com/data", "text/yaml", "yaml"},
+		{"exec://whatever", "", "text"},
+	}
+	for _, c := range cases {
+		if got := inferFormat(c.url, c.contentType); got != c.want {
+			t.Errorf("inferFormat(%q, %q) = %q, want %q", c.url, c.contentType, got, c.want)
+		}
+	}
+}
+
+func TestParseDatasourceContent(t *testing.T) {
+	v, err := parseDatasourceContent("json", []byte(`{"a":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := v.(map[string]interface{}); !ok || m["a"].(float64) != 1 {
+		t.Errorf("json: got %#v", v)
+	}
+
+	v, err = parseDatasourceContent("yaml", []byte("a: 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := v.(map[interface{}]interface{}); !ok || m["a"] != 1 {
+		t.Errorf("yaml: got %#v", v)
+	}
+
+	v, err = parseDatasourceContent("text", []byte("raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "raw" {
+		t.Errorf("text: got %#v", v)
+	}
+}
+
+func TestParseCSV(t *testing.T) {
+	v, err := parseCSV([]byte("name,age\nalice,30\nbob,40\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, ok := v.([]map[string]string)
+	if !ok || len(records) != 2 {
+		t.Fatalf("got %#v", v)
+	}
+	if records[0]["name"] != "alice" || records[0]["age"] != "30" {
+		t.Errorf("records[0] = %#v", records[0])
+	}
+	if records[1]["name"] != "bob" || records[1]["age"] != "40" {
+		t.Errorf("records[1] = %#v", records[1])
+	}
+}
+
+func TestLookupPath(t *testing.T) {
+	v := map[string]interface{}{
+		"a": map[string]interface{}{"b": "c"},
+	}
+	got, err := lookupPath(v, "a.b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "c" {
+		t.Errorf("got %#v, want %q", got, "c")
+	}
+
+	if _, err := lookupPath(v, "a.missing"); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+}
+
+// TestDatasourceFuncFile covers the file:// scheme end to end, including the
+// per-run cache: a second call must not re-read the file.
+func TestDatasourceFuncFile(t *testing.T) {
+	resetGlobalState(t)
+	dir := t.TempDir()
+	p := filepath.Join(dir, "data.json")
+	if err := os.WriteFile(p, []byte(`{"greeting":"hi"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dsRegistry["greeting"] = datasourceSpec{URL: "file://" + p, Timeout: defaultDatasourceTimeout}
+
+	v, err := datasourceFunc("greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok || m["greeting"] != "hi" {
+		t.Fatalf("got %#v", v)
+	}
+
+	got, err := dsFunc("greeting", "greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hi" {
+		t.Errorf("dsFunc = %#v, want %q", got, "hi")
+	}
+
+	// Remove the file: a cached read should still succeed since the cache
+	// is keyed by URL and populated on first use.
+	os.Remove(p)
+	if _, err := datasourceFunc("greeting"); err != nil {
+		t.Errorf("expected cached result despite file removal, got error: %s", err)
+	}
+}
+
+func TestDatasourceFuncEnv(t *testing.T) {
+	resetGlobalState(t)
+	os.Setenv("TEMPLATER_TEST_DS", "value-from-env")
+	t.Cleanup(func() { os.Unsetenv("TEMPLATER_TEST_DS") })
+	dsRegistry["envvar"] = datasourceSpec{URL: "env://TEMPLATER_TEST_DS", Timeout: defaultDatasourceTimeout}
+
+	v, err := datasourceFunc("envvar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "value-from-env" {
+		t.Errorf("got %#v, want %q", v, "value-from-env")
+	}
+}
+
+func TestDatasourceFuncExec(t *testing.T) {
+	resetGlobalState(t)
+	dsRegistry["shell"] = datasourceSpec{URL: "exec://echo -n hello", Timeout: defaultDatasourceTimeout}
+
+	v, err := datasourceFunc("shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "hello" {
+		t.Errorf("got %#v, want %q", v, "hello")
+	}
+}
+
+func TestDatasourceFuncHTTP(t *testing.T) {
+	resetGlobalState(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	t.Cleanup(srv.Close)
+	dsRegistry["api"] = datasourceSpec{URL: srv.URL, Timeout: defaultDatasourceTimeout}
+
+	v, err := datasourceFunc("api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok || m["ok"] != true {
+		t.Errorf("got %#v", v)
+	}
+}
+
+func TestDatasourceFuncHTTPErrorStatus(t *testing.T) {
+	resetGlobalState(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(srv.Close)
+	dsRegistry["broken"] = datasourceSpec{URL: srv.URL, Timeout: defaultDatasourceTimeout}
+
+	if _, err := datasourceFunc("broken"); err == nil {
+		t.Error("expected an error for a 500 response")
+	}
+}
+
+func TestDatasourceFuncUnknownName(t *testing.T) {
+	resetGlobalState(t)
+	if _, err := datasourceFunc("does-not-exist"); err == nil {
+		t.Error("expected an error for an unregistered datasource name")
+	}
+}
+
+// TestFetchVaultRequiresEnv covers the vault:// scheme's config validation,
+// which is all that's deterministically testable without a real Vault
+// server or credentials.
+func TestFetchVaultRequiresEnv(t *testing.T) {
+	os.Unsetenv("VAULT_ADDR")
+	os.Unsetenv("VAULT_TOKEN")
+	_, _, err := fetchVault(datasourceSpec{URL: "vault://secret/data/foo", Timeout: defaultDatasourceTimeout})
+	if err == nil {
+		t.Error("expected an error when VAULT_ADDR/VAULT_TOKEN are unset")
+	}
+}
+
+func TestRegisterDatasourcesMergesConfigAndFlags(t *testing.T) {
+	resetGlobalState(t)
+	flags = newTestFlags()
+	flags.datasources = DatasourceFlags{"fromFlag": "env://FROM_FLAG"}
+
+	bs := []byte("datasources:\n  fromConfig:\n    url: env://FROM_CONFIG\n    timeout: 5s\n")
+	registerDatasources(bs)
+
+	if dsRegistry["fromConfig"].URL != "env://FROM_CONFIG" {
+		t.Errorf("fromConfig = %#v", dsRegistry["fromConfig"])
+	}
+	if dsRegistry["fromConfig"].Timeout.String() != "5s" {
+		t.Errorf("fromConfig timeout = %s, want 5s", dsRegistry["fromConfig"].Timeout)
+	}
+	if dsRegistry["fromFlag"].URL != "env://FROM_FLAG" {
+		t.Errorf("fromFlag = %#v", dsRegistry["fromFlag"])
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// unifiedDiff renders a line-oriented unified diff between oldText and
+// newText, labelled with path. Used in --dry-run mode to preview what a scan
+// would change instead of just announcing that it would.
+func unifiedDiff(path string, oldText string, newText string) string {
+	dmp := diffmatchpatch.New()
+	wrapOld, wrapNew, lines := dmp.DiffLinesToChars(oldText, newText)
+	diffs := dmp.DiffMain(wrapOld, wrapNew, false)
+	diffs = dmp.DiffCharsToLines(diffs, lines)
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "--- a/%s\n+++ b/%s\n", path, path)
+
+	for _, d := range diffs {
+		prefix := " "
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			prefix = "+"
+		case diffmatchpatch.DiffDelete:
+			prefix = "-"
+		}
+		for _, line := range strings.SplitAfter(d.Text, "\n") {
+			if line == "" {
+				continue
+			}
+			fmt.Fprintf(buf, "%s%s\n", prefix, strings.TrimSuffix(line, "\n"))
+		}
+	}
+
+	return buf.String()
+}
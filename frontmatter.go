@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// frontMatterRegex matches an optional YAML document delimited by "---" lines
+// at the very top of a template file, e.g.:
+//
+//	---
+//	delims: ["<%", "%>"]
+//	out: ../shared/app.conf
+//	mode: 0600
+//	---
+//	<% .Host %>
+var frontMatterRegex = regexp.MustCompile(`(?s)^---\r?\n(.*?)\r?\n---\r?\n`)
+
+// frontMatter holds the per-file options a .tmpl file may declare above its body.
+type frontMatter struct {
+	// Delims overrides the left/right template delimiters for this file,
+	// e.g. ["<%", "%>"]. Falls back to --left-delim/--right-delim when unset.
+	Delims []string `yaml:"delims"`
+
+	// Out overrides convertOutputPath with an explicit output path, resolved
+	// relative to the template's normal output directory if not absolute.
+	Out string `yaml:"out"`
+
+	// Mode is the octal file permission to apply after writing, e.g. 0600 or
+	// "0600". Left alone (whatever os.Create/umask produced) when unset.
+	Mode interface{} `yaml:"mode"`
+
+	// Owner/Group chown the output file after writing (requires running as
+	// root, or as a user with permission to chown to these identities).
+	Owner string `yaml:"owner"`
+	Group string `yaml:"group"`
+
+	// SkipIf is a template, rendered with the same data as the file itself,
+	// that causes the file to be skipped entirely when it renders to "true".
+	SkipIf string `yaml:"skip_if"`
+
+	// Post is a shell command run after a successful write, e.g.
+	// "systemctl reload nginx".
+	Post string `yaml:"post"`
+}
+
+// fileMode interprets Mode, which front matter may express either as a bare
+// YAML octal integer (0600) or as a quoted string ("0600").
+func (fm frontMatter) fileMode() (os.FileMode, bool, error) {
+	switch v := fm.Mode.(type) {
+	case nil:
+		return 0, false, nil
+	case int:
+		return os.FileMode(v), true, nil
+	case string:
+		n, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid mode %q: %s", v, err)
+		}
+		return os.FileMode(n), true, nil
+	default:
+		return 0, false, fmt.Errorf("invalid mode value %v of type %T", v, v)
+	}
+}
+
+// splitFrontMatter extracts and parses any leading front matter, returning the
+// remaining template body. Files with no front matter are returned unchanged.
+func splitFrontMatter(bs []byte) (frontMatter, []byte, error) {
+	var fm frontMatter
+
+	loc := frontMatterRegex.FindSubmatchIndex(bs)
+	if loc == nil {
+		return fm, bs, nil
+	}
+
+	yamlPart := bs[loc[2]:loc[3]]
+	body := bs[loc[1]:]
+
+	if err := yaml.UnmarshalStrict(yamlPart, &fm); err != nil {
+		return fm, bs, fmt.Errorf("invalid front matter: %s", err)
+	}
+	if len(fm.Delims) != 0 && len(fm.Delims) != 2 {
+		return fm, bs, fmt.Errorf("invalid front matter: delims must have exactly 2 elements, got %d", len(fm.Delims))
+	}
+
+	return fm, body, nil
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"github.com/spf13/afero"
+)
+
+// appFs is the filesystem templater reads templates from and writes rendered
+// output to. In normal operation it's the real OS filesystem; --dry-run swaps
+// it for an in-memory layer on top of the OS filesystem (via useDryRunFs) so
+// that a dry run can be diffed without ever touching disk.
+var appFs afero.Fs = afero.NewOsFs()
+
+// useDryRunFs switches appFs to a copy-on-write filesystem: reads fall through
+// to the real filesystem, but every write lands in an in-memory overlay.
+func useDryRunFs() {
+	appFs = afero.NewCopyOnWriteFs(afero.NewOsFs(), afero.NewMemMapFs())
+}
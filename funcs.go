@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sync"
+	"text/template"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Masterminds/sprig/v3"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// buildFuncMap assembles the FuncMap shared by every template we parse: sprig's
+// string/path/regex/math/date/env/crypto helpers, plus a handful of additions
+// (structured-data marshalling, "required", "include") that sprig doesn't cover.
+//
+// "include" is registered here as a placeholder so that Parse's function-existence
+// check succeeds; the real implementation is bound per-execution via Funcs()
+// right before Execute, once we know the base directory and data for this file.
+func buildFuncMap() template.FuncMap {
+	fm := sprig.TxtFuncMap()
+
+	fm["toYaml"] = toYamlFunc
+	fm["fromYaml"] = fromYamlFunc
+	fm["toToml"] = toTomlFunc
+	fm["fromToml"] = fromTomlFunc
+	fm["required"] = requiredFunc
+	fm["datasource"] = datasourceFunc
+	fm["ds"] = dsFunc
+	fm["include"] = func(string) (string, error) {
+		return "", fmt.Errorf("include: not available in this context")
+	}
+
+	return fm
+}
+
+func toYamlFunc(v interface{}) (string, error) {
+	bs, err := yaml.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
+
+func fromYamlFunc(s string) (interface{}, error) {
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(s), &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func toTomlFunc(v interface{}) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := toml.NewEncoder(buf).Encode(v); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func fromTomlFunc(s string) (interface{}, error) {
+	var v interface{}
+	if err := toml.Unmarshal([]byte(s), &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// requiredFunc mirrors Helm's "required": it fails the render with a clear error
+// instead of silently emitting "<no value>" when a value is missing.
+func requiredFunc(warn string, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, errors.New(warn)
+	}
+	if s, ok := v.(string); ok && s == "" {
+		return nil, errors.New(warn)
+	}
+	return v, nil
+}
+
+// includeCache holds parsed *template.Template trees keyed by absolute path so
+// that a tree of templates composed via "include" is only parsed once per scan.
+// Guarded by includeCacheMu since scan() now renders files concurrently.
+var (
+	includeCacheMu sync.Mutex
+	includeCache   = map[string]*template.Template{}
+)
+
+// includeFunc returns the "include" implementation bound to the file currently
+// being rendered: relative paths resolve against baseDir, and the included
+// template is executed with the same data as the including template. Nested
+// includes are bound with that same data too, so a chain of includes three or
+// more deep still sees the real dot, not a nil baked in at parse time.
+func includeFunc(baseDir string, data interface{}) func(string) (string, error) {
+	return func(relPath string) (string, error) {
+		p := relPath
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(baseDir, relPath)
+		}
+
+		cached, err := loadIncludeTemplate(p)
+		if err != nil {
+			return "", fmt.Errorf("include %q: %s", relPath, err)
+		}
+
+		// The cached tree is shared across every render of this include, so
+		// clone it before binding this call's data-aware "include" - binding
+		// directly onto the cached *Template would race with other
+		// concurrent renders of the same include.
+		tmpl, err := cached.Clone()
+		if err != nil {
+			return "", fmt.Errorf("include %q: %s", relPath, err)
+		}
+		tmpl.Funcs(template.FuncMap{"include": includeFunc(path.Dir(p), data)})
+
+		buf := new(bytes.Buffer)
+		if err := tmpl.Execute(buf, data); err != nil {
+			return "", fmt.Errorf("include %q: %s", relPath, err)
+		}
+		return buf.String(), nil
+	}
+}
+
+// loadIncludeTemplate parses (and caches) the template tree at p, with
+// "include" left as buildFuncMap's inert placeholder - callers bind the real,
+// data-aware implementation onto their own clone of the cached tree.
+func loadIncludeTemplate(p string) (*template.Template, error) {
+	includeCacheMu.Lock()
+	cached, ok := includeCache[p]
+	includeCacheMu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	bs, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	fm, body, err := splitFrontMatter(bs)
+	if err != nil {
+		return nil, err
+	}
+	left, right := flags.delims()
+	if len(fm.Delims) == 2 {
+		left, right = fm.Delims[0], fm.Delims[1]
+	}
+
+	tmpl, err := template.New(path.Base(p)).Delims(left, right).Funcs(buildFuncMap()).Parse(string(body))
+	if err != nil {
+		return nil, err
+	}
+
+	includeCacheMu.Lock()
+	includeCache[p] = tmpl
+	includeCacheMu.Unlock()
+	return tmpl, nil
+}
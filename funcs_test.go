@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestToYamlFromYamlRoundTrip(t *testing.T) {
+	s, err := toYamlFunc(map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := fromYamlFunc(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok || m["a"] != 1 {
+		t.Errorf("fromYamlFunc(toYamlFunc(...)) = %#v, want map with a: 1", v)
+	}
+}
+
+func TestToTomlFromTomlRoundTrip(t *testing.T) {
+	s, err := toTomlFunc(map[string]interface{}{"a": "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := fromTomlFunc(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok || m["a"] != "b" {
+		t.Errorf("fromTomlFunc(toTomlFunc(...)) = %#v, want map with a: b", v)
+	}
+}
+
+// TestRequiredFuncPreservesPercent guards against the round-2 regression
+// where fmt.Errorf(warn) treated the message as a format string.
+func TestRequiredFuncPreservesPercent(t *testing.T) {
+	_, err := requiredFunc("value needs to be 100% set", nil)
+	if err == nil {
+		t.Fatal("expected an error for a nil value")
+	}
+	if err.Error() != "value needs to be 100% set" {
+		t.Errorf("err = %q, want the message preserved verbatim", err.Error())
+	}
+}
+
+func TestRequiredFuncPassesThroughNonEmpty(t *testing.T) {
+	v, err := requiredFunc("must be set", "hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if v != "hello" {
+		t.Errorf("v = %#v, want %q", v, "hello")
+	}
+}
+
+func TestRequiredFuncRejectsEmptyString(t *testing.T) {
+	_, err := requiredFunc("must not be blank", "")
+	if err == nil {
+		t.Fatal("expected an error for an empty string")
+	}
+}
+
+// TestRenderBodyCustomDelims exercises chunk0-1's --left-delim/--right-delim
+// support end to end through renderBody.
+func TestRenderBodyCustomDelims(t *testing.T) {
+	resetGlobalState(t)
+	chdirTemp(t)
+	appFs = afero.NewMemMapFs()
+	flags = newTestFlags()
+	*flags.leftDelim = "[["
+	*flags.rightDelim = "]]"
+
+	buf := new(bytes.Buffer)
+	if err := renderBody([]byte("host=[[ .Host ]]"), frontMatter{}, "", buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() == 0 || bytes.Contains(buf.Bytes(), []byte("[[")) {
+		t.Errorf("custom delimiters were not honored, got %q", buf.String())
+	}
+}
+
+// TestIncludeNestedDataThreading guards against the round-2 regression where
+// loadIncludeTemplate cached each include tree with its nested include bound
+// to nil, so a chain three files deep lost the real dot. a includes b
+// includes c, and only c actually reads .Host.
+func TestIncludeNestedDataThreading(t *testing.T) {
+	resetGlobalState(t)
+	cwd := chdirTemp(t)
+	appFs = afero.NewOsFs()
+	flags = newTestFlags()
+	*flags.hostOverride = "myhost"
+	os.Setenv("TEMPLATER_CONFIG", filepath.Join(cwd, "config.yaml"))
+	t.Cleanup(func() { os.Unsetenv("TEMPLATER_CONFIG") })
+
+	if err := os.WriteFile(filepath.Join(cwd, "b.tmpl"), []byte(`{{ include "c.tmpl" }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cwd, "c.tmpl"), []byte(`host={{ .Host }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := renderBody([]byte(`{{ include "b.tmpl" }}`), frontMatter{}, cwd, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "host=myhost"; got != want {
+		t.Errorf("nested include rendered %q, want %q", got, want)
+	}
+}
+
+// TestIncludeCachedTreeReusableWithDifferentData asserts that the same
+// cached include tree renders correctly for two different data values,
+// proving loadIncludeTemplate's cache isn't mutated by the first call's data.
+func TestIncludeCachedTreeReusableWithDifferentData(t *testing.T) {
+	resetGlobalState(t)
+	cwd := chdirTemp(t)
+	appFs = afero.NewOsFs()
+	flags = newTestFlags()
+
+	if err := os.WriteFile(filepath.Join(cwd, "greet.tmpl"), []byte(`hi {{ .Name }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fn := includeFunc(cwd, nil)
+	first, err := fn("greet.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fn2 := includeFunc(cwd, map[string]interface{}{"Name": "nobody"})
+	_, _ = fn2("greet.tmpl")
+
+	second, err := includeFunc(cwd, nil)("greet.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Errorf("first render = %q, second render (after a differently-bound call) = %q, want equal", first, second)
+	}
+}
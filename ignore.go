@@ -0,0 +1,207 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sabhiram/go-gitignore"
+	"github.com/spf13/afero"
+)
+
+const ignoreFileName = ".templaterignore"
+
+// rawIgnoreLines caches the raw, untranslated lines of dir's .templaterignore,
+// or nil if dir has none.
+var (
+	rawIgnoreLinesMu    sync.Mutex
+	rawIgnoreLinesCache = map[string][]string{}
+)
+
+func loadRawIgnoreLines(dir string) []string {
+	rawIgnoreLinesMu.Lock()
+	defer rawIgnoreLinesMu.Unlock()
+
+	if lines, ok := rawIgnoreLinesCache[dir]; ok {
+		return lines
+	}
+
+	bs, err := afero.ReadFile(appFs, path.Join(dir, ignoreFileName))
+	if err != nil {
+		rawIgnoreLinesCache[dir] = nil
+		return nil
+	}
+
+	lines := strings.Split(string(bs), "\n")
+	rawIgnoreLinesCache[dir] = lines
+	return lines
+}
+
+// combinedCache caches one merged matcher per leaf directory, keyed by that
+// directory's absolute path.
+var (
+	combinedMu    sync.Mutex
+	combinedCache = map[string]*ignore.GitIgnore{}
+)
+
+// combinedMatcher builds (or returns the cached) matcher for leafDir: the
+// patterns of every .templaterignore from cwd down to leafDir, translated to
+// be relative to cwd and concatenated root-to-leaf. Evaluating them as one
+// combined pattern list (rather than one independent matcher per directory)
+// is what lets a "!" negation in a closer directory re-include something a
+// parent's rules excluded, matching real gitignore semantics.
+func combinedMatcher(cwd, leafDir string) *ignore.GitIgnore {
+	combinedMu.Lock()
+	if m, ok := combinedCache[leafDir]; ok {
+		combinedMu.Unlock()
+		return m
+	}
+	combinedMu.Unlock()
+
+	var all []string
+	for _, dir := range ignoreChain(cwd, leafDir) {
+		dirRel, err := filepath.Rel(cwd, dir)
+		if err != nil {
+			continue
+		}
+		for _, line := range loadRawIgnoreLines(dir) {
+			if t := translatePattern(dirRel, line); t != "" {
+				all = append(all, t)
+			}
+		}
+	}
+
+	m := ignore.CompileIgnoreLines(all...)
+
+	combinedMu.Lock()
+	combinedCache[leafDir] = m
+	combinedMu.Unlock()
+	return m
+}
+
+// translatePattern rewrites one line of dir's .templaterignore (where dir is
+// dirRel relative to cwd) into a pattern anchored at cwd, so it can be merged
+// with patterns from other directories without bleeding outside dir's subtree.
+// A pattern with no slash matches at any depth under dir, per gitignore rule 6,
+// so it's translated via "dirRel/**/pattern"; an already-anchored or
+// slash-containing pattern is translated via "dirRel/pattern". Blank lines and
+// comments return "".
+func translatePattern(dirRel, line string) string {
+	trimmed := strings.TrimRight(line, "\r")
+	s := strings.TrimSpace(trimmed)
+	if s == "" || strings.HasPrefix(s, "#") {
+		return ""
+	}
+	if dirRel == "." {
+		return trimmed
+	}
+
+	negate := false
+	body := trimmed
+	if strings.HasPrefix(body, "!") {
+		negate = true
+		body = body[1:]
+	}
+
+	anchored := strings.HasPrefix(body, "/")
+	body = strings.TrimPrefix(body, "/")
+	hasInnerSlash := strings.Contains(strings.TrimSuffix(body, "/"), "/")
+
+	var translated string
+	if anchored || hasInnerSlash {
+		translated = dirRel + "/" + body
+	} else {
+		translated = dirRel + "/**/" + body
+	}
+	translated = "/" + translated
+
+	if negate {
+		translated = "!" + translated
+	}
+	return translated
+}
+
+// ignoreChain returns dir and its ancestors up to and including cwd, ordered
+// root-to-leaf (cwd first).
+func ignoreChain(cwd, dir string) []string {
+	var chain []string
+	for {
+		chain = append(chain, dir)
+		if dir == cwd {
+			break
+		}
+		parent := path.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain
+}
+
+// isIgnored reports whether p (an absolute path under cwd) is excluded by the
+// .templaterignore files between cwd and p's immediate directory, merged
+// root-to-leaf so a closer directory's rules (including "!" negations)
+// override a parent's.
+func isIgnored(cwd, p string) bool {
+	rel, err := filepath.Rel(cwd, p)
+	if err != nil {
+		return false
+	}
+	return combinedMatcher(cwd, path.Dir(p)).MatchesPath(rel)
+}
+
+// GlobFlags collects repeated --include/--exclude glob flags.
+type GlobFlags []string
+
+func (g *GlobFlags) String() string {
+	if g == nil {
+		return ""
+	}
+	return strings.Join(*g, ",")
+}
+
+func (g *GlobFlags) Set(value string) error {
+	*g = append(*g, value)
+	return nil
+}
+
+// matchesAny reports whether rel (cwd-relative) or its basename matches any
+// of the given glob patterns.
+func matchesAny(patterns []string, rel string) bool {
+	base := path.Base(rel)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldProcess applies .templaterignore plus --include/--exclude to decide
+// whether a scanned template file should be rendered at all.
+func (f *Flags) shouldProcess(cwd, scannedPath string) bool {
+	if isIgnored(cwd, scannedPath) {
+		return false
+	}
+
+	rel, err := filepath.Rel(cwd, scannedPath)
+	if err != nil {
+		rel = scannedPath
+	}
+
+	if len(f.exclude) > 0 && matchesAny(f.exclude, rel) {
+		return false
+	}
+	if len(f.include) > 0 && !matchesAny(f.include, rel) {
+		return false
+	}
+	return true
+}
@@ -15,9 +15,13 @@ import (
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"text/template"
 
+	"github.com/spf13/afero"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -37,7 +41,6 @@ InDocker: false
 const extension = "tmpl"
 
 var flags *Flags
-var t *template.Template = template.New("templater")
 var templRegEx *regexp.Regexp = regexp.MustCompile("^.*(\\." + extension + ")(\\.|$)")
 
 func nicePath(path string) string {
@@ -54,6 +57,10 @@ func nicePath(path string) string {
 	return out
 }
 
+// scan walks the tree for .tmpl files honoring .templaterignore and
+// --include/--exclude, then renders the matches across a worker pool bounded
+// by -j. Per-file stdout output is buffered and flushed in walk order so
+// concurrency doesn't make the output racy.
 func scan() {
 
 	cwd, err := os.Getwd()
@@ -61,94 +68,208 @@ func scan() {
 		log.Fatalf("Failed to get working dir: %s", err)
 	}
 
-	e := filepath.Walk(cwd, func(p string, info os.FileInfo, err error) error {
-		// TODO: make this configurable
-		if info.IsDir() && info.Name() == ".templater" {
-			return filepath.SkipDir
+	var scannedPaths []string
+	e := afero.Walk(appFs, cwd, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if p != cwd && isIgnored(cwd, p) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !templRegEx.MatchString(info.Name()) {
+			return nil
 		}
-		if err == nil && templRegEx.MatchString(info.Name()) {
-			scannedPath := p
+		if !flags.shouldProcess(cwd, p) {
+			return nil
+		}
+		if !path.IsAbs(p) {
+			panic(p + " is not absolute")
+		}
+		scannedPaths = append(scannedPaths, p)
+		return nil
+	})
+	if e != nil {
+		log.Fatal(e)
+	}
+
+	// Warm the config cache once, serially, before fanning out: config()'s
+	// check-then-set isn't safe to race from multiple worker goroutines.
+	config()
+
+	jobs := *flags.jobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	reports := make([]string, len(scannedPaths))
+	var aborted int32
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+
+	for i, scannedPath := range scannedPaths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, scannedPath string) {
+			defer wg.Done()
+			defer func() { <-sem }()
 
-			if !path.IsAbs(scannedPath) {
-				panic(scannedPath + " is not absolute")
+			if *flags.transactional && atomic.LoadInt32(&aborted) != 0 {
+				reports[i] = fmt.Sprintf("Skipping %s: scan aborted after an earlier failure.\n", nicePath(scannedPath))
+				return
 			}
 
-			outputPath := convertOutputPath(scannedPath)
+			failed, report := processScannedFile(scannedPath)
+			reports[i] = report
+			if failed && *flags.transactional {
+				atomic.StoreInt32(&aborted, 1)
+			}
+		}(i, scannedPath)
+	}
+	wg.Wait()
 
-			r, err := flags.inputReader(scannedPath)
-			if err != nil {
-				log.Printf("Failed to open for reading %s: %s ... skipping", nicePath(scannedPath), err.Error())
-				return nil
+	for _, report := range reports {
+		fmt.Print(report)
+	}
+
+	if atomic.LoadInt32(&aborted) != 0 {
+		rollbackAll()
+		log.Fatalf("Aborted scan after a failure; rolled back all writes from this run.")
+	}
+}
+
+// processScannedFile renders one scanned template and applies its front
+// matter, returning whether it failed and the stdout report to print for it.
+func processScannedFile(scannedPath string) (bool, string) {
+	out := new(strings.Builder)
+
+	bs, err := afero.ReadFile(appFs, scannedPath)
+	if err != nil {
+		log.Printf("Failed to open for reading %s: %s ... skipping", nicePath(scannedPath), err.Error())
+		return false, ""
+	}
+
+	fm, body, err := splitFrontMatter(bs)
+	if err != nil {
+		log.Printf("Failed to read front matter in %s: %s ... skipping", nicePath(scannedPath), err.Error())
+		return false, ""
+	}
+
+	outputPath := convertOutputPath(scannedPath)
+	if fm.Out != "" {
+		outputPath = resolveFrontMatterOut(outputPath, fm.Out)
+	}
+
+	if fm.SkipIf != "" {
+		skip, err := evalSkipIf(fm, path.Dir(scannedPath))
+		if err != nil {
+			log.Printf("Failed to evaluate skip_if in %s: %s ... skipping", nicePath(scannedPath), err.Error())
+			return false, ""
+		}
+		if skip {
+			if *flags.porcelain {
+				fmt.Fprintf(out, "SKIP\t%s\t%s\n", nicePath(scannedPath), nicePath(outputPath))
+			} else {
+				fmt.Fprintf(out, "Skipping %s (skip_if matched).\n", nicePath(scannedPath))
 			}
+			return false, out.String()
+		}
+	}
 
-			var mode string
-			b := new(bytes.Buffer)
-			err = executeTemplate(r, b)
-			if err != nil {
-				log.Printf("Failed to execute template %s:\n    %s\n", nicePath(scannedPath), err.Error())
-				mode = "FAIL"
+	var mode string
+	var existing *bytes.Buffer
+	b := new(bytes.Buffer)
+	err = renderBody(body, fm, path.Dir(scannedPath), b)
+	if err != nil {
+		log.Printf("Failed to execute template %s:\n    %s\n", nicePath(scannedPath), err.Error())
+		mode = "FAIL"
+	} else {
+		existing, err = flags.getExistingOutputFileContents(outputPath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Unexpected error getting existing output contents: %s", err.Error())
+			}
+			mode = "CREATE"
+		} else {
+			if !reflect.DeepEqual(b.Bytes(), existing.Bytes()) {
+				mode = "MODIFY"
 			} else {
-				existing, err := flags.getExistingOutputFileContents(outputPath)
-				if err != nil {
-					if !os.IsNotExist(err) {
-						log.Printf("Unexpected error getting existing output contents: %s", err.Error())
-					}
-					mode = "CREATE"
-				} else {
-					if !reflect.DeepEqual(b.Bytes(), existing.Bytes()) {
-						mode = "MODIFY"
-					} else {
-						mode = "KEEP"
-					}
-				}
+				mode = "KEEP"
 			}
+		}
+	}
 
-			if mode == "MODIFY" || mode == "CREATE" {
+	if mode == "MODIFY" || mode == "CREATE" {
 
-				w, err := flags.outputWriter(outputPath)
-				if err != nil {
-					if err == skipReplace {
-						// skip quietly: user just confirmed
-						return nil
-					}
-					log.Printf("Failed to create file %s: %s ... skipping", nicePath(outputPath), err.Error())
-					return nil
-				}
+		w, err := flags.outputWriter(outputPath)
+		if err != nil {
+			if err == skipReplace {
+				// skip quietly: user just confirmed
+				return false, ""
+			}
+			log.Printf("Failed to create file %s: %s ... skipping", nicePath(outputPath), err.Error())
+			return false, ""
+		}
 
-				_, err = io.Copy(w, b)
-				if err != nil {
-					log.Printf("Unexpected error copying file: %s", err)
-					mode = "FAIL"
+		if _, err := io.Copy(w, bytes.NewReader(b.Bytes())); err != nil {
+			log.Printf("Unexpected error copying file: %s", err)
+			mode = "FAIL"
+			w.Abort()
+		} else if err := w.Commit(); err != nil {
+			log.Printf("Failed to write %s: %s", nicePath(outputPath), err.Error())
+			mode = "FAIL"
+		} else {
+			var preImage []byte
+			if existing != nil {
+				preImage = existing.Bytes()
+			}
+			recordCompletedWrite(outputPath, preImage)
+
+			if *flags.readOnly {
+				if err := markFileReadOnly(outputPath); err != nil {
+					log.Printf("Failed to mark output path read only: %s", err.Error())
 				}
-				if *flags.readOnly {
-					err = markFileReadOnly(outputPath)
-					if err != nil {
-						log.Printf("Failed to mark output path read only: %s", err.Error())
-					}
+			}
+			if err := applyMode(outputPath, fm); err != nil {
+				log.Printf("Failed to apply mode to %s: %s", nicePath(outputPath), err.Error())
+			}
+			if !flags.shouldDryRun() {
+				if err := applyOwnership(outputPath, fm); err != nil {
+					log.Printf("Failed to apply ownership to %s: %s", nicePath(outputPath), err.Error())
+				}
+				if err := runPostHook(outputPath, fm); err != nil {
+					log.Printf("Post hook for %s failed: %s", nicePath(outputPath), err.Error())
 				}
 			}
+		}
+	}
 
-			if *flags.porcelain {
-				fmt.Printf("%s\t%s\t%s\n", mode, nicePath(scannedPath), nicePath(outputPath))
-			} else {
-				switch mode {
-				case "KEEP":
-					fmt.Printf("No change made to %s. Skipping.\n", nicePath(outputPath))
-				case "MODIFY":
-					fmt.Printf("Re-writing %s to %s.\n", nicePath(scannedPath), nicePath(outputPath))
-				case "CREATE":
-					fmt.Printf("Writing %s to new file %s.\n", nicePath(scannedPath), nicePath(outputPath))
-				case "FAIL":
-					fmt.Printf("Failed to process %s. Skipping.\n", nicePath(scannedPath))
+	if *flags.porcelain {
+		fmt.Fprintf(out, "%s\t%s\t%s\n", mode, nicePath(scannedPath), nicePath(outputPath))
+	} else {
+		switch mode {
+		case "KEEP":
+			fmt.Fprintf(out, "No change made to %s. Skipping.\n", nicePath(outputPath))
+		case "MODIFY", "CREATE":
+			if flags.shouldDryRun() {
+				oldText := ""
+				if existing != nil {
+					oldText = existing.String()
 				}
+				out.WriteString(unifiedDiff(nicePath(outputPath), oldText, b.String()))
+			} else if mode == "MODIFY" {
+				fmt.Fprintf(out, "Re-writing %s to %s.\n", nicePath(scannedPath), nicePath(outputPath))
+			} else {
+				fmt.Fprintf(out, "Writing %s to new file %s.\n", nicePath(scannedPath), nicePath(outputPath))
 			}
+		case "FAIL":
+			fmt.Fprintf(out, "Failed to process %s. Skipping.\n", nicePath(scannedPath))
 		}
-		return nil
-	})
-	if e != nil {
-		log.Fatal(e)
 	}
 
+	return mode == "FAIL", out.String()
 }
 
 func configFile() string {
@@ -156,15 +277,15 @@ func configFile() string {
 	if configPath == "" {
 		configPath = os.ExpandEnv("$HOME/.config/templater/config")
 	}
-	_, err := os.Stat(configPath)
+	_, err := appFs.Stat(configPath)
 
 	if os.IsNotExist(err) {
 		dir := path.Dir(configPath)
-		err := os.MkdirAll(dir, os.ModePerm)
+		err := appFs.MkdirAll(dir, os.ModePerm)
 		if err != nil {
 			panic(err.Error())
 		}
-		f, err := os.Create(configPath)
+		f, err := appFs.Create(configPath)
 		if err != nil {
 			panic(err.Error())
 		}
@@ -178,15 +299,24 @@ func configFile() string {
 	return configPath
 }
 
-var cachedConfig *Config = nil
+var (
+	cachedConfigMu sync.Mutex
+	cachedConfig   *Config = nil
+)
 
+// config loads and caches the config file plus any -override-host/-user
+// flags, the same way across every render. Guarded by cachedConfigMu since
+// scan() renders concurrently.
 func config() Config {
+	cachedConfigMu.Lock()
+	defer cachedConfigMu.Unlock()
+
 	if cachedConfig != nil {
 		return *cachedConfig
 	}
 
 	configFile := configFile()
-	bs, err := ioutil.ReadFile(configFile)
+	bs, err := afero.ReadFile(appFs, configFile)
 	if err != nil {
 		panic(err.Error())
 	}
@@ -196,6 +326,7 @@ func config() Config {
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	registerDatasources(bs)
 
 	config := Config{Values: exConfig}
 
@@ -283,31 +414,20 @@ func convertOutputPath(scannedPath string) string {
 var skipReplace error = errors.New("should skip")
 
 func markFileReadOnly(outputPath string) error {
-	return os.Chmod(outputPath, 0444)
+	return appFs.Chmod(outputPath, 0444)
 }
 
-func createOutputFile(outputPath string) (io.Writer, error) {
-	os.Remove(outputPath)
-	dir := path.Dir(outputPath)
-	err := os.MkdirAll(dir, os.ModePerm)
-	if err != nil {
-		return nil, err
-	}
-
-	return os.Create(outputPath)
+func createOutputFile(outputPath string) (transactionalWriter, error) {
+	return createAtomicFile(outputPath)
 }
 
-func promptAndCreateOutputFile(outputPath string) (io.Writer, error) {
-	if flags.shouldDryRun() {
-		return ioutil.Discard, nil
-	}
-
+func promptAndCreateOutputFile(outputPath string) (transactionalWriter, error) {
 	if !flags.shouldPromptBeforeWrite() {
 		// no interactive, just try to create
 		return createOutputFile(outputPath)
 	}
 
-	if _, err := os.Stat(outputPath); err != nil {
+	if _, err := appFs.Stat(outputPath); err != nil {
 		// interactive but does not exist
 		return createOutputFile(outputPath)
 
@@ -327,17 +447,25 @@ func promptAndCreateOutputFile(outputPath string) (io.Writer, error) {
 }
 
 type Flags struct {
-	scan         *bool
-	porcelain    *bool
-	dryRun       *bool
-	interactive  *bool
-	readOnly     *bool
-	out          *string
-	in           *string
-	origParent   *string
-	newParent    *string
-	hostOverride *string
-	userOverride *string
+	scan          *bool
+	porcelain     *bool
+	dryRun        *bool
+	interactive   *bool
+	readOnly      *bool
+	out           *string
+	in            *string
+	origParent    *string
+	newParent     *string
+	hostOverride  *string
+	userOverride  *string
+	leftDelim     *string
+	rightDelim    *string
+	datasources   DatasourceFlags
+	backup        *bool
+	transactional *bool
+	jobs          *int
+	include       GlobFlags
+	exclude       GlobFlags
 }
 
 func (f *Flags) shouldScan() bool {
@@ -349,7 +477,7 @@ func (f *Flags) shouldDryRun() bool {
 }
 
 func (f *Flags) shouldPromptBeforeWrite() bool {
-	return *f.interactive && !f.isStdin()
+	return *f.interactive && !f.isStdin() && !f.shouldDryRun()
 }
 
 func (f *Flags) isValid() bool {
@@ -360,14 +488,47 @@ func (f *Flags) isStdin() bool {
 	return *f.in == "" && !*f.scan
 }
 
+// delims returns the left/right template delimiters set via
+// --left-delim/--right-delim, falling back to the text/template default.
+func (f *Flags) delims() (string, string) {
+	left, right := *f.leftDelim, *f.rightDelim
+	if left == "" {
+		left = "{{"
+	}
+	if right == "" {
+		right = "}}"
+	}
+	return left, right
+}
+
+// inputDir returns the directory a scanned or non-scan input is rooted in, so
+// that per-file functions like "include" can resolve relative paths.
+func (f *Flags) inputDir(scannedPath string) string {
+	if scannedPath != "" {
+		return path.Dir(scannedPath)
+	}
+	if f.isStdin() {
+		cwd, err := os.Getwd()
+		if err != nil {
+			log.Fatalf("Failed to get working dir: %s", err)
+		}
+		return cwd
+	}
+	abs, err := filepath.Abs(*f.in)
+	if err != nil {
+		log.Fatalf("Error for %s: %s", *f.in, err)
+	}
+	return path.Dir(abs)
+}
+
 func (f *Flags) inputReader(scannedPath string) (io.Reader, error) {
 	if scannedPath != "" {
-		return os.Open(scannedPath)
+		return appFs.Open(scannedPath)
 	}
 	if f.isStdin() {
 		return os.Stdin, nil
 	} else {
-		return os.Open(*f.in)
+		return appFs.Open(*f.in)
 	}
 }
 
@@ -387,7 +548,7 @@ func (f *Flags) getExistingOutputFileContents(outputPath string) (*bytes.Buffer,
 	if outputPath == "" {
 		panic("outputPath required")
 	}
-	file, err := os.Open(outputPath)
+	file, err := appFs.Open(outputPath)
 	if err != nil {
 		return nil, err
 	}
@@ -400,14 +561,14 @@ func (f *Flags) getExistingOutputFileContents(outputPath string) (*bytes.Buffer,
 	return buf, nil
 }
 
-func (f *Flags) outputWriter(outputPath string) (io.Writer, error) {
+func (f *Flags) outputWriter(outputPath string) (transactionalWriter, error) {
 	if outputPath != "" {
 		return promptAndCreateOutputFile(outputPath)
 	}
 
 	outputPath = f.getOutputPathForNonScan()
 	if outputPath == "" {
-		return os.Stdout, nil
+		return stdoutWriter{os.Stdout}, nil
 	} else {
 		return promptAndCreateOutputFile(outputPath)
 	}
@@ -429,20 +590,41 @@ func (f *Flags) origParentAbs() string {
 	return abs
 }
 
-func executeTemplate(r io.Reader, w io.Writer) error {
-	bs, err := ioutil.ReadAll(r)
+// renderBody parses and executes a template body (with any front matter
+// already stripped) against the current config, honoring fm.Delims and
+// binding "include" relative to baseDir.
+func renderBody(body []byte, fm frontMatter, baseDir string, w io.Writer) error {
+	left, right := flags.delims()
+	if len(fm.Delims) == 2 {
+		left, right = fm.Delims[0], fm.Delims[1]
+	}
+
+	config := config()
+
+	// A fresh *template.Template per render: text/template.Template isn't
+	// safe for concurrent Parse/Delims/Execute on a shared instance, and
+	// scan() renders files concurrently.
+	templ, err := template.New("templater").Funcs(buildFuncMap()).Delims(left, right).Parse(string(body))
 	if err != nil {
 		return err
 	}
+	templ.Funcs(template.FuncMap{"include": includeFunc(baseDir, config)})
+
+	return templ.Execute(w, config)
+}
 
-	templ, err := t.Parse(string(bs))
+func executeTemplate(r io.Reader, w io.Writer, baseDir string) error {
+	bs, err := ioutil.ReadAll(r)
 	if err != nil {
 		return err
 	}
 
-	config := config()
+	fm, body, err := splitFrontMatter(bs)
+	if err != nil {
+		return err
+	}
 
-	return templ.Execute(w, config)
+	return renderBody(body, fm, baseDir, w)
 }
 
 func main() {
@@ -458,7 +640,18 @@ func main() {
 		flag.String("new", "", "new path prefix"),
 		flag.String("override-host", "", "Override the value provided by .Host"),
 		flag.String("override-user", "", "Override the value provided by .User"),
-	}
+		flag.String("left-delim", "", "Left template delimiter (default \"{{\")"),
+		flag.String("right-delim", "", "Right template delimiter (default \"}}\")"),
+		nil,
+		flag.Bool("backup", false, "keep a .bak copy of any file a scan overwrites"),
+		flag.Bool("transactional", false, "roll back all writes from this scan if any template fails"),
+		flag.Int("j", runtime.NumCPU(), "number of templates to render concurrently (-scan only)"),
+		nil,
+		nil,
+	}
+	flag.Var(&flags.datasources, "d", "datasource in the form name=url (repeatable)")
+	flag.Var(&flags.include, "include", "only process scanned files matching this glob (repeatable, -scan only)")
+	flag.Var(&flags.exclude, "exclude", "skip scanned files matching this glob (repeatable, -scan only)")
 
 	flag.Parse()
 
@@ -468,6 +661,10 @@ func main() {
 		return
 	}
 
+	if flags.shouldDryRun() {
+		useDryRunFs()
+	}
+
 	if flags.shouldScan() {
 		scan()
 	} else {
@@ -484,24 +681,49 @@ func main() {
 		}
 
 		if flags.shouldDryRun() {
-			read := *flags.in
 			if flags.isStdin() {
-				read = "<stdin>"
+				// it's kind of weird to do a dry run with stdin
+				fmt.Printf("Will read from <stdin> and write to %s\n",
+					nicePath(flags.getOutputPathForNonScan()))
+				w.Abort()
+				return
 			}
 
-			fmt.Printf("Will read from %s and write to %s\n",
-				read, nicePath(flags.getOutputPathForNonScan()))
+			outputPath := flags.getOutputPathForNonScan()
+			if outputPath == "" {
+				fmt.Printf("Will read from %s and write to <stdout>\n", *flags.in)
+				w.Abort()
+				return
+			}
+			if abs, err := filepath.Abs(outputPath); err == nil {
+				outputPath = abs
+			}
 
-			if flags.isStdin() {
-				// it's kind of weird to do a dry run with stdin
+			b := new(bytes.Buffer)
+			if err := executeTemplate(r, b, flags.inputDir("")); err != nil {
+				w.Abort()
+				log.Fatalf("Failed execute template: \n    %s", err.Error())
 				return
 			}
+
+			oldText := ""
+			if existing, err := flags.getExistingOutputFileContents(outputPath); err == nil {
+				oldText = existing.String()
+			}
+			fmt.Print(unifiedDiff(nicePath(outputPath), oldText, b.String()))
+			w.Abort()
+			return
 		}
 
-		err = executeTemplate(r, w)
+		err = executeTemplate(r, w, flags.inputDir(""))
 		if err != nil {
+			w.Abort()
 			log.Fatalf("Failed execute template: \n    %s", err.Error())
 			return
 		}
+		if err := w.Commit(); err != nil {
+			log.Fatalf("Failed to write output: %s", err.Error())
+			return
+		}
 	}
 }
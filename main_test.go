@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"text/template"
+
+	"github.com/sabhiram/go-gitignore"
+	"github.com/spf13/afero"
+)
+
+// newTestFlags builds a Flags with every pointer populated, so tests don't
+// have to replicate flag.Bool/flag.String's zero-value plumbing from main().
+func newTestFlags() *Flags {
+	boolFalse := func() *bool { b := false; return &b }
+	strEmpty := func() *string { s := ""; return &s }
+	jobs := 2
+	return &Flags{
+		scan:          boolFalse(),
+		porcelain:     boolFalse(),
+		dryRun:        boolFalse(),
+		interactive:   boolFalse(),
+		readOnly:      boolFalse(),
+		out:           strEmpty(),
+		in:            strEmpty(),
+		origParent:    strEmpty(),
+		newParent:     strEmpty(),
+		hostOverride:  strEmpty(),
+		userOverride:  strEmpty(),
+		leftDelim:     strEmpty(),
+		rightDelim:    strEmpty(),
+		datasources:   DatasourceFlags{},
+		backup:        boolFalse(),
+		transactional: boolFalse(),
+		jobs:          &jobs,
+	}
+}
+
+// resetGlobalState clears every cache that's normally populated once per
+// process, so each test starts from a clean slate regardless of run order.
+func resetGlobalState(t *testing.T) {
+	t.Helper()
+	cachedConfig = nil
+	dsRegistry = map[string]datasourceSpec{}
+	dsCache = map[string]interface{}{}
+	includeCache = map[string]*template.Template{}
+	completedWrites = nil
+	rawIgnoreLinesCache = map[string][]string{}
+	combinedCache = map[string]*ignore.GitIgnore{}
+}
+
+// chdirTemp chdirs into a fresh real-disk temp directory for the duration of
+// the test, restoring the original cwd on cleanup. scan() relies on
+// os.Getwd(), so tests that drive it need a real directory to anchor to even
+// when appFs itself is in-memory.
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	old, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(old) })
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resolved
+}
+
+// captureStdout redirects os.Stdout for the duration of fn and returns what
+// was written to it. scan() prints its report directly to os.Stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	old := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	fn()
+	w.Close()
+	os.Stdout = old
+
+	var buf bytes.Buffer
+	io.Copy(&buf, r)
+	return buf.String()
+}
+
+// TestRenderBodyIndependentPerCall guards against chunk0-6's parallel-render
+// regression: renderBody used to Parse onto a single shared *template.Template,
+// so concurrent renders could stomp each other's parse trees. Each call must
+// only ever see its own body.
+func TestRenderBodyIndependentPerCall(t *testing.T) {
+	resetGlobalState(t)
+	chdirTemp(t)
+	appFs = afero.NewMemMapFs()
+	flags = newTestFlags()
+
+	const n = 50
+	results := make([]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := []byte(fmt.Sprintf("file-%d", i))
+			buf := new(bytes.Buffer)
+			if err := renderBody(body, frontMatter{}, "", buf); err != nil {
+				t.Errorf("renderBody(%d): %s", i, err)
+				return
+			}
+			results[i] = buf.String()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, got := range results {
+		want := fmt.Sprintf("file-%d", i)
+		if got != want {
+			t.Errorf("result[%d] = %q, want %q", i, got, want)
+		}
+	}
+}
+
+// TestScanDryRunDoesNotTouchDisk exercises chunk0-3/chunk0-6 together: a
+// --dry-run scan should report what it would write without ever creating the
+// file on the real filesystem.
+func TestScanDryRunDoesNotTouchDisk(t *testing.T) {
+	resetGlobalState(t)
+	cwd := chdirTemp(t)
+	useDryRunFs()
+	flags = newTestFlags()
+	*flags.scan = true
+	*flags.dryRun = true
+	*flags.porcelain = true
+
+	if err := os.WriteFile(filepath.Join(cwd, "a.conf.tmpl"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := captureStdout(t, scan)
+
+	if !bytes.Contains([]byte(out), []byte("CREATE\ta.conf.tmpl\ta.conf")) {
+		t.Errorf("expected a CREATE report for a.conf, got: %q", out)
+	}
+	if _, err := os.Stat(filepath.Join(cwd, "a.conf")); !os.IsNotExist(err) {
+		t.Errorf("dry run must not create a.conf on the real filesystem, stat err = %v", err)
+	}
+}
+
+// TestScanDryRunSkipsPostHook guards chunk0-4's dry-run regression: a post:
+// hook shells out for real regardless of appFs, so it must be gated on
+// shouldDryRun() explicitly rather than relying on the dry-run fs overlay.
+func TestScanDryRunSkipsPostHook(t *testing.T) {
+	resetGlobalState(t)
+	cwd := chdirTemp(t)
+	useDryRunFs()
+	flags = newTestFlags()
+	*flags.scan = true
+	*flags.dryRun = true
+	*flags.porcelain = true
+
+	marker := filepath.Join(cwd, "marker")
+	tmpl := fmt.Sprintf("---\npost: \"%s %s\"\n---\nhello\n", "touch", marker)
+	if err := os.WriteFile(filepath.Join(cwd, "a.conf.tmpl"), []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	captureStdout(t, scan)
+
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Errorf("post hook must not run during --dry-run, marker stat err = %v", err)
+	}
+
+	// Sanity check the hook does fire on a real (non-dry-run) scan.
+	resetGlobalState(t)
+	appFs = afero.NewOsFs()
+	flags = newTestFlags()
+	*flags.scan = true
+	*flags.porcelain = true
+	report := captureStdout(t, scan)
+
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("expected post hook to run on a real scan, marker stat err = %v; report: %s", err, report)
+	}
+	exec.Command("rm", "-f", marker).Run()
+}
+
+// TestRecordAndRollbackCompletedWrite exercises the --transactional rollback
+// mechanism directly, without going through scan()'s log.Fatalf abort path
+// (which would exit the test process).
+func TestRecordAndRollbackCompletedWrite(t *testing.T) {
+	resetGlobalState(t)
+	cwd := chdirTemp(t)
+	appFs = afero.NewMemMapFs()
+	flags = newTestFlags()
+	*flags.transactional = true
+
+	existingPath := filepath.Join(cwd, "existing.conf")
+	newPath := filepath.Join(cwd, "new.conf")
+
+	if err := afero.WriteFile(appFs, existingPath, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	existing, err := flags.getExistingOutputFileContents(existingPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordCompletedWrite(existingPath, existing.Bytes())
+	if err := afero.WriteFile(appFs, existingPath, []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	recordCompletedWrite(newPath, nil)
+	if err := afero.WriteFile(appFs, newPath, []byte("created"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rollbackAll()
+
+	bs, err := afero.ReadFile(appFs, existingPath)
+	if err != nil || string(bs) != "original" {
+		t.Errorf("existing.conf = %q, %v; want \"original\", nil", bs, err)
+	}
+	if _, err := appFs.Stat(newPath); !os.IsNotExist(err) {
+		t.Errorf("new.conf should have been removed by rollback, stat err = %v", err)
+	}
+}
+
+// TestIsIgnoredNestedNegation guards chunk0-6's ignore-merging fix: a closer
+// .templaterignore's "!" negation must be able to re-include a file a
+// parent directory's rules excluded.
+func TestIsIgnoredNestedNegation(t *testing.T) {
+	resetGlobalState(t)
+	cwd := chdirTemp(t)
+	appFs = afero.NewOsFs()
+
+	if err := os.WriteFile(filepath.Join(cwd, ".templaterignore"), []byte("*.tmpl\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sub := filepath.Join(cwd, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sub, ".templaterignore"), []byte("!keep.tmpl\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if isIgnored(cwd, filepath.Join(sub, "other.tmpl")) != true {
+		t.Error("sub/other.tmpl should still be ignored by the root rule")
+	}
+	if isIgnored(cwd, filepath.Join(sub, "keep.tmpl")) != false {
+		t.Error("sub/keep.tmpl should be re-included by sub's negation")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// resolveFrontMatterOut applies a front matter "out:" override on top of the
+// path convertOutputPath would otherwise have produced: absolute overrides are
+// used verbatim, relative ones are resolved against the default's directory.
+func resolveFrontMatterOut(defaultOutputPath string, out string) string {
+	if path.IsAbs(out) {
+		return out
+	}
+	return path.Join(path.Dir(defaultOutputPath), out)
+}
+
+// evalSkipIf renders fm.SkipIf (a template, not a bare expression) against
+// the current config and reports whether it rendered to exactly "true".
+func evalSkipIf(fm frontMatter, baseDir string) (bool, error) {
+	buf := new(bytes.Buffer)
+	if err := renderBody([]byte(fm.SkipIf), fm, baseDir, buf); err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(buf.String()) == "true", nil
+}
+
+// applyMode applies fm's "mode:" override to outputPath, if set.
+func applyMode(outputPath string, fm frontMatter) error {
+	mode, ok, err := fm.fileMode()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	return appFs.Chmod(outputPath, mode)
+}
+
+// applyOwnership applies fm's "owner:"/"group:" overrides to outputPath via
+// chown, looking up whichever of the two are set. A -1 id leaves that half of
+// the ownership unchanged, per chown(2) semantics.
+func applyOwnership(outputPath string, fm frontMatter) error {
+	if fm.Owner == "" && fm.Group == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+
+	if fm.Owner != "" {
+		u, err := user.Lookup(fm.Owner)
+		if err != nil {
+			return fmt.Errorf("owner %q: %s", fm.Owner, err)
+		}
+		uid, err = strconv.Atoi(u.Uid)
+		if err != nil {
+			return err
+		}
+	}
+
+	if fm.Group != "" {
+		g, err := user.LookupGroup(fm.Group)
+		if err != nil {
+			return fmt.Errorf("group %q: %s", fm.Group, err)
+		}
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	return appFs.Chown(outputPath, uid, gid)
+}
+
+// runPostHook runs fm's "post:" command, if set, after a successful write.
+func runPostHook(outputPath string, fm frontMatter) error {
+	if fm.Post == "" {
+		return nil
+	}
+	cmd := exec.Command("sh", "-c", fm.Post)
+	cmd.Env = append(os.Environ(), "TEMPLATER_OUTPUT="+outputPath)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("post hook failed: %s\n%s", err, out)
+	}
+	return nil
+}
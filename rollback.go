@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// completedWrite is enough to undo one write from this scan() run: either
+// the file didn't exist before (so rollback removes it) or it did (so
+// rollback restores its prior content and mode).
+type completedWrite struct {
+	outputPath string
+	wasNew     bool
+	preImage   []byte
+	preMode    os.FileMode
+}
+
+// completedWrites accumulates across a scan() run when --transactional is
+// set, so that a later failure can roll everything back. Guarded by
+// completedWritesMu since scan() renders concurrently.
+var (
+	completedWritesMu sync.Mutex
+	completedWrites   []completedWrite
+)
+
+func recordCompletedWrite(outputPath string, existing []byte) {
+	if !*flags.transactional {
+		return
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := appFs.Stat(outputPath); err == nil {
+		mode = info.Mode()
+	}
+
+	completedWritesMu.Lock()
+	completedWrites = append(completedWrites, completedWrite{
+		outputPath: outputPath,
+		wasNew:     existing == nil,
+		preImage:   existing,
+		preMode:    mode,
+	})
+	completedWritesMu.Unlock()
+}
+
+// rollbackAll undoes every write recorded so far in this run, most recent
+// first, and clears the record.
+func rollbackAll() {
+	completedWritesMu.Lock()
+	defer completedWritesMu.Unlock()
+	for i := len(completedWrites) - 1; i >= 0; i-- {
+		w := completedWrites[i]
+		if w.wasNew {
+			if err := appFs.Remove(w.outputPath); err != nil {
+				log.Printf("Rollback: failed to remove %s: %s", nicePath(w.outputPath), err.Error())
+				continue
+			}
+			log.Printf("Rolled back (removed) %s", nicePath(w.outputPath))
+		} else {
+			if err := afero.WriteFile(appFs, w.outputPath, w.preImage, w.preMode); err != nil {
+				log.Printf("Rollback: failed to restore %s: %s", nicePath(w.outputPath), err.Error())
+				continue
+			}
+			log.Printf("Rolled back (restored) %s", nicePath(w.outputPath))
+		}
+	}
+	completedWrites = nil
+}